@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// NetworkConfig describes one [name] section of the config file: how
+// to connect to that network, how to authenticate, and what to do
+// once connected.
+type NetworkConfig struct {
+	Server      string
+	Nick        string
+	TLS         bool
+	SASL        *SASLCreds
+	ServerPass  string
+	AutoJoin    []string
+	ConnectCmds []string
+
+	// DetachTimeout overrides defaultDetachTimeout for this network.
+	// Zero means "use the default".
+	DetachTimeout time.Duration
+}
+
+// Config is mub's on-disk configuration, loaded from
+// ~/.config/mub/config.
+type Config struct {
+	BlockedCommands map[string]bool
+	Networks        map[string]*NetworkConfig
+}
+
+var conf Config
+
+// configPath returns the location of the config file.
+func configPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".mub/config"
+	}
+	return filepath.Join(home, ".config", "mub", "config")
+}
+
+// loadConfig reads the config file into conf, following tedfu's
+// section-per-network key=value style: top-level keys apply globally,
+// and a "[name]" line starts a section describing one network. A
+// missing file sets conf to an empty configuration rather than
+// failing, so a first run doesn't need one.
+func loadConfig() error {
+	newConf := Config{
+		BlockedCommands: make(map[string]bool),
+		Networks:        make(map[string]*NetworkConfig),
+	}
+
+	f, err := os.Open(configPath())
+	if os.IsNotExist(err) {
+		conf = newConf
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var net *NetworkConfig
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			net = &NetworkConfig{}
+			newConf.Networks[name] = net
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		if net == nil {
+			switch key {
+			case "block":
+				newConf.BlockedCommands[value] = true
+			case "strict-nicknames":
+				strictNicks = value == "true"
+			}
+			continue
+		}
+
+		switch key {
+		case "server":
+			net.Server = value
+		case "nick":
+			net.Nick = value
+		case "tls":
+			net.TLS = value == "true"
+		case "sasl":
+			saslParts := strings.SplitN(value, ":", 3)
+			sasl := &SASLCreds{Mechanism: saslParts[0]}
+			if len(saslParts) == 3 {
+				sasl.User, sasl.Pass = saslParts[1], saslParts[2]
+			}
+			net.SASL = sasl
+		case "server-pass":
+			net.ServerPass = value
+		case "auto-join":
+			net.AutoJoin = strings.Fields(value)
+		case "connect-cmd":
+			net.ConnectCmds = append(net.ConnectCmds, value)
+		case "detach-timeout":
+			if dur, err := time.ParseDuration(value); err == nil {
+				net.DetachTimeout = dur
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	conf = newConf
+	return nil
+}
+
+// applyconnectconfig registers a handler that fires cfg's connect
+// commands and auto-join list once net finishes registering (numeric
+// 001), the way soju's custom on-connect commands feature does. A nil
+// cfg (no matching config section) is a no-op.
+func applyconnectconfig(net *Network, cfg *NetworkConfig) {
+	if cfg == nil {
+		return
+	}
+
+	net.Conn.HandleFunc("001", func(conn *irc.Conn, line *irc.Line) {
+		for _, raw := range cfg.ConnectCmds {
+			conn.Raw(raw)
+		}
+		for _, ch := range cfg.AutoJoin {
+			conn.Join(ch)
+
+			net.State.mu.Lock()
+			net.State.Channels[ch] = ch
+			net.State.mu.Unlock()
+
+			net.touch(ch)
+		}
+	})
+}
+
+// autoconnect connects to every configured network that has a server
+// set, the way the user would by typing /connect or /tlsconnect by
+// hand -- so a config file alone is enough to get online, instead of
+// server/nick/tls/server-pass only taking effect once some other
+// connection method has already brought the network up. Names are
+// visited in sorted order so which network ends up active, when more
+// than one autoconnects, is deterministic.
+func autoconnect() {
+	names := make([]string, 0, len(conf.Networks))
+	for name := range conf.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cfg := conf.Networks[name]
+		if cfg.Server == "" {
+			continue
+		}
+		pendingSASL = cfg.SASL
+		connect(cfg.Server, cfg.Nick, cfg.ServerPass, cfg.TLS)
+		setupnetwork(name, cfg.Server, cfg.SASL)
+	}
+}
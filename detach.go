@@ -0,0 +1,139 @@
+package main
+
+import "time"
+
+// defaultDetachTimeout is how long a joined channel can sit idle
+// (no messages sent, no focus) before mub auto-detaches it, unless
+// the network's config overrides it with detach-timeout.
+const defaultDetachTimeout = 30 * time.Minute
+
+// ChannelActivity tracks the idle timer behind a channel's
+// auto-detach, mirroring soju's upstreamChannel detach timer.
+type ChannelActivity struct {
+	Timer *time.Timer
+}
+
+// touch resets channel's idle timer on net, detaching it once
+// detachTimeout passes without another touch.
+func (net *Network) touch(channel string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.touchLocked(channel)
+}
+
+// touchLocked is touch's body; callers must already hold net.mu.
+func (net *Network) touchLocked(channel string) {
+	if net.Activity == nil {
+		net.Activity = make(map[string]*ChannelActivity)
+	}
+
+	act, ok := net.Activity[channel]
+	if !ok {
+		act = &ChannelActivity{}
+		net.Activity[channel] = act
+	}
+	if act.Timer != nil {
+		act.Timer.Stop()
+	}
+	act.Timer = time.AfterFunc(net.detachTimeout(), func() {
+		detachchannel(net, channel)
+	})
+}
+
+// forget stops channel's idle timer on net, e.g. because the channel
+// was parted or removed from the network entirely.
+func (net *Network) forget(channel string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.forgetLocked(channel)
+}
+
+// forgetLocked is forget's body; callers must already hold net.mu.
+func (net *Network) forgetLocked(channel string) {
+	if act, ok := net.Activity[channel]; ok {
+		act.Timer.Stop()
+		delete(net.Activity, channel)
+	}
+}
+
+// detachTimeout returns how long net's channels may idle before
+// auto-detaching, honoring a per-network config override.
+func (net *Network) detachTimeout() time.Duration {
+	if cfg := conf.Networks[net.Name]; cfg != nil && cfg.DetachTimeout > 0 {
+		return cfg.DetachTimeout
+	}
+	return defaultDetachTimeout
+}
+
+// detachchannel moves channel from net's joined set into its detached
+// set and stops its idle timer, without parting it. net.CurrTarget is
+// left unchanged.
+//
+// DEVIATION FROM SPEC: the request text says "the client issues PART".
+// This deliberately does not: mub is a single client, not a bouncer
+// like soju sitting between the user and an always-joined upstream
+// connection. If detachchannel actually PARTed, the server would stop
+// delivering the very messages onincoming relies on to trigger a
+// transparent reattach -- the request's other requirement -- and
+// detach would become permanent until the user manually /attach'd and
+// rejoined. Kept as a local-only hide so reattach-on-message keeps
+// working; flagging this explicitly rather than leaving it as a silent
+// difference from the request. If a real PART is required regardless,
+// reattachchannel will need to re-Join instead of just un-hiding.
+func detachchannel(net *Network, channel string) {
+	net.State.mu.Lock()
+	_, joined := net.State.Channels[channel]
+	if joined {
+		delete(net.State.Channels, channel)
+		net.State.Detached[channel] = channel
+	}
+	net.State.mu.Unlock()
+
+	if joined {
+		net.forget(channel)
+	}
+}
+
+// reattachchannel un-hides channel. Since detachchannel never parted
+// it, there's nothing to rejoin server-side -- this is local
+// bookkeeping only. It's a no-op if channel isn't currently detached.
+func reattachchannel(net *Network, channel string) {
+	net.State.mu.Lock()
+	_, detached := net.State.Detached[channel]
+	if detached {
+		delete(net.State.Detached, channel)
+		net.State.Channels[channel] = channel
+	}
+	net.State.mu.Unlock()
+
+	if detached {
+		net.touch(channel)
+	}
+}
+
+// onincoming handles an incoming PRIVMSG/NOTICE arriving on target:
+// it transparently reattaches (un-hides) target first if it had been
+// detached. Because detachchannel never actually parts, the server
+// keeps delivering messages for a detached channel, which is what
+// makes this possible at all. A highlight (a mention of our own nick)
+// needs no special case here: any incoming message, mention or not,
+// already reattaches immediately -- there's no coalescing or delay to
+// bypass.
+//
+// It does not touch target's idle timer on the non-detached path:
+// idleness is scoped to channels the user hasn't spoken in or focused,
+// so other people's traffic on a channel the user never uses must not
+// keep it alive. The user's own activity already resets the timer, via
+// touch calls in handleJoin, handleMsg, handleMe and handleQuery.
+func onincoming(net *Network, nick, target, text string, action bool, ts time.Time) {
+	net.State.mu.Lock()
+	_, detached := net.State.Detached[target]
+	net.State.mu.Unlock()
+
+	if detached {
+		reattachchannel(net, target)
+	}
+
+	showmsg(nick, target, text, action, ts)
+	history.Append(net.Name, target, HistoryMessage{Nick: nick, Time: ts, Action: action, Text: text})
+}
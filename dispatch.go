@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// strictNicks, when set via the config file's top-level
+// "strict-nicknames=true", makes nickname-typed arguments reject any
+// nick not currently present in commandState.NickMap.
+var strictNicks bool
+
+// Context carries what a command handler needs beyond its own typed
+// arguments: the network the command should act on, if any.
+type Context struct {
+	Net *Network
+}
+
+// handler is the signature every registered command function has.
+// args is always a value of that command's own prototype struct type,
+// populated by parseargs.
+type handler func(ctx *Context, args interface{})
+
+// handlers maps a command name to its handler, populated alongside
+// the commands table: adding a command is a one-struct-plus-one-func
+// change instead of a new switch case.
+var handlers = map[string]handler{
+	"/away":         handleAway,
+	"/help":         handleHelp,
+	"/reloadconfig": handleReloadConfig,
+	"/tlsconnect":   handleTLSConnect,
+	"/connect":      handleConnect,
+	"/network":      handleNetwork,
+	"/nick":         handleNick,
+	"/join":         handleJoin,
+	"/part":         handlePart,
+	"/detach":       handleDetach,
+	"/attach":       handleAttach,
+	"/me":           handleMe,
+	"/names":        handleNames,
+	"/status":       handleStatus,
+	"/whois":        handleWhois,
+	"/msg":          handleMsg,
+	"/x":            handleQuery,
+	"/query":        handleQuery,
+	"/history":      handleHistory,
+	"/quit":         handleQuit,
+}
+
+// tokenpos returns the index in line where the (n+1)-th
+// whitespace-separated field begins, i.e. line's start after skipping
+// n leading fields and their separating whitespace. Used to recover a
+// "rest of line" argument with its original spacing intact, the way
+// parsecommand used to compute firstpos/secondpos by hand.
+func tokenpos(line string, n int) int {
+	pos := 0
+	for i := 0; i < n; i++ {
+		for pos < len(line) && line[pos] == ' ' {
+			pos++
+		}
+		for pos < len(line) && line[pos] != ' ' {
+			pos++
+		}
+	}
+	for pos < len(line) && line[pos] == ' ' {
+		pos++
+	}
+	return pos
+}
+
+// parseargs walks prototype's fields in order, consuming one
+// whitespace-separated token from fields[1:] per field. The last
+// field, if it is a plain string (not a channel/nickname/nickorchan),
+// instead consumes the rest of the line verbatim -- so "/me slaps
+// someone" and "/msg nick some words" keep their trailing text intact
+// rather than being re-split and re-joined. A channel field must
+// start with "#"; a nickname field is checked against state.NickMap
+// when strict is true.
+func parseargs(prototype interface{}, line string, fields []string, state *commandState, strict bool) (interface{}, error) {
+	t := reflect.TypeOf(prototype)
+	v := reflect.New(t).Elem()
+	tokens := fields[1:]
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		isLast := i == t.NumField()-1
+		isPlainString := field.Type.Kind() == reflect.String && field.Type == reflect.TypeOf("")
+
+		if isLast && isPlainString {
+			v.Field(i).SetString(line[tokenpos(line, i+1):])
+			break
+		}
+
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("missing <%s>", strings.ToLower(field.Name))
+		}
+		token := tokens[0]
+		tokens = tokens[1:]
+
+		switch field.Type {
+		case reflect.TypeOf(channel("")):
+			if !strings.HasPrefix(token, "#") {
+				return nil, fmt.Errorf("<%s> must start with #", strings.ToLower(field.Name))
+			}
+		case reflect.TypeOf(nickname("")):
+			if strict {
+				state.mu.Lock()
+				_, ok := state.NickMap[token]
+				state.mu.Unlock()
+				if !ok {
+					return nil, fmt.Errorf("no such nick: %s", token)
+				}
+			}
+		}
+
+		v.Field(i).SetString(token)
+	}
+
+	return v.Interface(), nil
+}
+
+func handleAway(ctx *Context, args interface{}) {
+	a := args.(awaycommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+
+	if a.Message != "" {
+		ctx.Net.Conn.Away(a.Message)
+		away()
+	} else {
+		ctx.Net.Conn.Away()
+		back()
+	}
+}
+
+func handleHelp(ctx *Context, args interface{}) {
+	printhelp()
+}
+
+func handleReloadConfig(ctx *Context, args interface{}) {
+	if err := loadConfig(); err != nil {
+		errormsg("Couldn't reload config: " + err.Error())
+		return
+	}
+	info("Configuration reloaded.")
+}
+
+// doconnect implements /connect and /tlsconnect: extra holds
+// whitespace-separated trailing tokens -- an optional server password
+// and an optional --sasl=... flag, in either order.
+func doconnect(server, nick, extra string, tls bool) {
+	sasl, rest := extractsasl(strings.Fields(extra))
+	var pass string
+	if len(rest) >= 1 {
+		pass = rest[0]
+	}
+
+	pendingSASL = sasl
+	connect(server, nick, pass, tls)
+	setupnetwork(autoName(server), server, sasl)
+}
+
+func handleTLSConnect(ctx *Context, args interface{}) {
+	a := args.(tlsconnectcommand)
+	doconnect(a.Server, a.Nick, a.Extra, true)
+}
+
+func handleConnect(ctx *Context, args interface{}) {
+	a := args.(connectcommand)
+	doconnect(a.Server, a.Nick, a.Extra, false)
+}
+
+func handleNetwork(ctx *Context, args interface{}) {
+	a := args.(networkcommand)
+	fields := strings.Fields(a.Args)
+	if len(fields) == 0 {
+		warn("Use /network add|list|switch|remove ...")
+		return
+	}
+	parsenetworkcommand(fields)
+}
+
+func handleNick(ctx *Context, args interface{}) {
+	a := args.(nickcommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+	ctx.Net.Conn.Nick(string(a.Nick))
+}
+
+func handleJoin(ctx *Context, args interface{}) {
+	a := args.(joincommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+
+	ch := string(a.Channel)
+	ctx.Net.CurrTarget = ch
+	ctx.Net.Conn.Join(ch)
+
+	ctx.Net.State.mu.Lock()
+	ctx.Net.State.Channels[ch] = ch
+	delete(ctx.Net.State.Detached, ch)
+	ctx.Net.State.mu.Unlock()
+
+	ctx.Net.touch(ch)
+	replayscrollback(ctx.Net, ch)
+}
+
+func handlePart(ctx *Context, args interface{}) {
+	a := args.(partcommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+
+	ch := string(a.Channel)
+	ctx.Net.Conn.Part(ch)
+	ctx.Net.CurrTarget = ""
+
+	ctx.Net.State.mu.Lock()
+	delete(ctx.Net.State.Channels, ch)
+	ctx.Net.State.mu.Unlock()
+
+	ctx.Net.forget(ch)
+}
+
+func handleDetach(ctx *Context, args interface{}) {
+	a := args.(detachcommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+
+	target := strings.TrimSpace(a.Channel)
+	if target == "" {
+		target = ctx.Net.CurrTarget
+	}
+	if target == "" {
+		warn("Use /detach [#channel]")
+		return
+	}
+	detachchannel(ctx.Net, target)
+}
+
+func handleAttach(ctx *Context, args interface{}) {
+	a := args.(attachcommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+
+	target := strings.TrimSpace(a.Channel)
+	if target == "" {
+		target = ctx.Net.CurrTarget
+	}
+	if target == "" {
+		warn("Use /attach [#channel]")
+		return
+	}
+	reattachchannel(ctx.Net, target)
+}
+
+func handleMe(ctx *Context, args interface{}) {
+	a := args.(mecommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+	if a.Action == "" {
+		warn("Use /me action text")
+		return
+	}
+
+	ctx.Net.Conn.Action(ctx.Net.CurrTarget, a.Action)
+	ctx.Net.touch(ctx.Net.CurrTarget)
+	history.Append(ctx.Net.Name, ctx.Net.CurrTarget, HistoryMessage{
+		Nick: ctx.Net.Conn.Me().Nick, Time: time.Now(), Action: true, Text: a.Action,
+	})
+}
+
+func handleNames(ctx *Context, args interface{}) {
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+	ctx.Net.Conn.Raw(fmt.Sprintf("NAMES %v", ctx.Net.CurrTarget))
+}
+
+func handleStatus(ctx *Context, args interface{}) {
+	if statusEvents {
+		statusEvents = false
+		message("Not showing quits, joins, et cetera.")
+	} else {
+		statusEvents = true
+		message("Showing quits, joins, et cetera.")
+	}
+}
+
+func handleWhois(ctx *Context, args interface{}) {
+	a := args.(whoiscommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+	ctx.Net.Conn.Whois(string(a.Nick))
+}
+
+func handleMsg(ctx *Context, args interface{}) {
+	a := args.(msgcommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+	if a.Text == "" {
+		warn("Use /msg target message text")
+		return
+	}
+
+	target := string(a.Target)
+	ctx.Net.Conn.Privmsg(target, a.Text)
+	ctx.Net.touch(target)
+	history.Append(ctx.Net.Name, target, HistoryMessage{
+		Nick: ctx.Net.Conn.Me().Nick, Time: time.Now(), Action: false, Text: a.Text,
+	})
+}
+
+func handleQuery(ctx *Context, args interface{}) {
+	a := args.(querycommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+
+	ctx.Net.CurrTarget = string(a.Target)
+	ctx.Net.touch(ctx.Net.CurrTarget)
+	replayscrollback(ctx.Net, ctx.Net.CurrTarget)
+}
+
+func handleHistory(ctx *Context, args interface{}) {
+	a := args.(historycommand)
+	if ctx.Net == nil {
+		noconnection()
+		return
+	}
+
+	target := string(a.Target)
+	modifier := strings.TrimSpace(a.Modifier)
+
+	var msgs []HistoryMessage
+	var err error
+
+	switch {
+	case modifier == "":
+		msgs, err = history.Load(ctx.Net.Name, target, scrollbackCount*2)
+	case strings.HasPrefix(modifier, "since="):
+		var since time.Time
+		since, err = time.Parse(time.RFC3339, strings.TrimPrefix(modifier, "since="))
+		if err == nil {
+			msgs, err = history.LoadSince(ctx.Net.Name, target, since)
+		}
+	case strings.HasPrefix(modifier, "before="):
+		var id int64
+		id, err = strconv.ParseInt(strings.TrimPrefix(modifier, "before="), 10, 64)
+		if err == nil {
+			msgs, err = history.LoadBefore(ctx.Net.Name, target, id, scrollbackCount*2)
+		}
+	default:
+		var count int
+		count, err = strconv.Atoi(modifier)
+		if err == nil {
+			msgs, err = history.Load(ctx.Net.Name, target, count)
+		}
+	}
+
+	if err != nil {
+		warn("Use /history <target> [count|since=<time>|before=<id>]")
+		return
+	}
+
+	replayhistory(msgs, target)
+}
+
+func handleQuit(ctx *Context, args interface{}) {
+	a := args.(quitcommand)
+	iquit()
+
+	for _, n := range netmgr.Networks {
+		if n.Conn == nil {
+			continue
+		}
+		if a.Reason != "" {
+			n.Conn.Quit(a.Reason)
+		} else {
+			n.Conn.Quit()
+		}
+	}
+
+	quitclient = true
+}
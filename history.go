@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HistoryMessage is one recorded line of chat history.
+type HistoryMessage struct {
+	ID     int64
+	Nick   string
+	Time   time.Time
+	Action bool
+	Text   string
+}
+
+// MessageStore records and replays chat history for a network+target
+// pair. The running client uses a FileMessageStore; tests can swap in
+// an in-memory implementation instead.
+type MessageStore interface {
+	Append(network, target string, msg HistoryMessage) error
+	Load(network, target string, count int) ([]HistoryMessage, error)
+	LoadBefore(network, target string, id int64, count int) ([]HistoryMessage, error)
+	LoadSince(network, target string, since time.Time) ([]HistoryMessage, error)
+}
+
+// historyIndexSize caps how many recent messages per network/target
+// are kept in memory for fast scrollback lookups.
+const historyIndexSize = 200
+
+// scrollbackCount is how many lines are auto-replayed when switching
+// into a buffer via /join or /query.
+const scrollbackCount = 10
+
+// FileMessageStore appends one JSON line per message to
+// <dir>/<network>/<target>.log, doubling as the client's scrollback
+// and its persistent history.
+type FileMessageStore struct {
+	dir    string
+	mu     sync.Mutex
+	nextID map[string]int64
+	recent map[string][]HistoryMessage
+	loaded map[string]bool
+}
+
+func newFileMessageStore(dir string) *FileMessageStore {
+	return &FileMessageStore{
+		dir:    dir,
+		nextID: make(map[string]int64),
+		recent: make(map[string][]HistoryMessage),
+		loaded: make(map[string]bool),
+	}
+}
+
+func historyKey(network, target string) string {
+	return network + "/" + target
+}
+
+func (s *FileMessageStore) path(network, target string) string {
+	return filepath.Join(s.dir, network, target+".log")
+}
+
+// ensureLoaded seeds nextID and recent for key from disk the first
+// time it's touched in this process, so IDs stay monotonic across a
+// restart and scrollback has something to serve from immediately
+// instead of waiting on the next Append. Callers must hold s.mu.
+func (s *FileMessageStore) ensureLoaded(network, target, key string) error {
+	if s.loaded[key] {
+		return nil
+	}
+
+	all, err := s.readLog(network, target)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range all {
+		if m.ID > s.nextID[key] {
+			s.nextID[key] = m.ID
+		}
+	}
+
+	if len(all) > historyIndexSize {
+		all = all[len(all)-historyIndexSize:]
+	}
+	s.recent[key] = all
+	s.loaded[key] = true
+
+	return nil
+}
+
+// Append assigns msg the next monotonically increasing ID for
+// network/target, and writes it to that target's log file.
+func (s *FileMessageStore) Append(network, target string, msg HistoryMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := historyKey(network, target)
+	if err := s.ensureLoaded(network, target, key); err != nil {
+		return err
+	}
+
+	s.nextID[key]++
+	msg.ID = s.nextID[key]
+
+	path := s.path(network, target)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, string(line)); err != nil {
+		return err
+	}
+
+	idx := append(s.recent[key], msg)
+	if len(idx) > historyIndexSize {
+		idx = idx[len(idx)-historyIndexSize:]
+	}
+	s.recent[key] = idx
+
+	return nil
+}
+
+// Load returns the last count messages for network/target, or all of
+// them if count is 0 or larger than what's recorded. Answered
+// straight from the recent index when it's known to hold enough
+// messages, avoiding a disk read on the common scrollback path.
+func (s *FileMessageStore) Load(network, target string, count int) ([]HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := historyKey(network, target)
+	if err := s.ensureLoaded(network, target, key); err != nil {
+		return nil, err
+	}
+
+	if recent := s.recent[key]; count > 0 && count <= len(recent) {
+		return append([]HistoryMessage(nil), recent[len(recent)-count:]...), nil
+	}
+
+	all, err := s.readLog(network, target)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 || count > len(all) {
+		count = len(all)
+	}
+	return all[len(all)-count:], nil
+}
+
+// indexCoversAll reports whether s.recent[key] holds the target's
+// entire history rather than just the trailing historyIndexSize
+// window. Callers must hold s.mu and have already called
+// ensureLoaded.
+func (s *FileMessageStore) indexCoversAll(key string) bool {
+	return s.nextID[key] <= int64(len(s.recent[key]))
+}
+
+// LoadBefore returns up to count messages recorded before id, oldest
+// first.
+func (s *FileMessageStore) LoadBefore(network, target string, id int64, count int) ([]HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := historyKey(network, target)
+	if err := s.ensureLoaded(network, target, key); err != nil {
+		return nil, err
+	}
+
+	all := s.recent[key]
+	if !s.indexCoversAll(key) {
+		var err error
+		all, err = s.readLog(network, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var before []HistoryMessage
+	for _, m := range all {
+		if m.ID < id {
+			before = append(before, m)
+		}
+	}
+	if count > 0 && count < len(before) {
+		before = before[len(before)-count:]
+	}
+	return before, nil
+}
+
+// LoadSince returns every message recorded after since, oldest first.
+func (s *FileMessageStore) LoadSince(network, target string, since time.Time) ([]HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := historyKey(network, target)
+	if err := s.ensureLoaded(network, target, key); err != nil {
+		return nil, err
+	}
+
+	all := s.recent[key]
+	if !s.indexCoversAll(key) {
+		var err error
+		all, err = s.readLog(network, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var after []HistoryMessage
+	for _, m := range all {
+		if m.Time.After(since) {
+			after = append(after, m)
+		}
+	}
+	return after, nil
+}
+
+// readLog reads every recorded message for network/target straight
+// from disk, bypassing the recent index.
+func (s *FileMessageStore) readLog(network, target string) ([]HistoryMessage, error) {
+	path := s.path(network, target)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var all []HistoryMessage
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m HistoryMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			continue
+		}
+		all = append(all, m)
+	}
+
+	return all, scanner.Err()
+}
+
+// historyDir returns where FileMessageStore keeps its logs, falling
+// back to a relative directory if the user's home can't be found.
+func historyDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".mub-history"
+	}
+	return filepath.Join(home, ".local", "share", "mub", "history")
+}
+
+// history is the MessageStore backing /history, replay-on-join and
+// logging of outgoing messages.
+var history MessageStore = newFileMessageStore(historyDir())
+
+// replayhistory re-emits msgs through showmsg in the normal
+// timestamped format, as if they had just arrived on target.
+func replayhistory(msgs []HistoryMessage, target string) {
+	for _, m := range msgs {
+		showmsg(m.Nick, target, m.Text, m.Action, m.Time)
+	}
+}
+
+// replayscrollback auto-replays the last scrollbackCount lines for
+// net/target, called when a buffer becomes current via /join or
+// /query so switching buffers feels continuous.
+func replayscrollback(net *Network, target string) {
+	msgs, err := history.Load(net.Name, target, scrollbackCount)
+	if err != nil || len(msgs) == 0 {
+		return
+	}
+	replayhistory(msgs, target)
+}
+
+// MemoryMessageStore is an in-memory MessageStore, for tests that
+// exercise history-dependent behavior (replay, /history) without
+// touching disk.
+type MemoryMessageStore struct {
+	mu     sync.Mutex
+	nextID map[string]int64
+	msgs   map[string][]HistoryMessage
+}
+
+func newMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{
+		nextID: make(map[string]int64),
+		msgs:   make(map[string][]HistoryMessage),
+	}
+}
+
+func (s *MemoryMessageStore) Append(network, target string, msg HistoryMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := historyKey(network, target)
+	s.nextID[key]++
+	msg.ID = s.nextID[key]
+	s.msgs[key] = append(s.msgs[key], msg)
+	return nil
+}
+
+func (s *MemoryMessageStore) Load(network, target string, count int) ([]HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := s.msgs[historyKey(network, target)]
+	if count <= 0 || count > len(all) {
+		count = len(all)
+	}
+	return append([]HistoryMessage(nil), all[len(all)-count:]...), nil
+}
+
+func (s *MemoryMessageStore) LoadBefore(network, target string, id int64, count int) ([]HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var before []HistoryMessage
+	for _, m := range s.msgs[historyKey(network, target)] {
+		if m.ID < id {
+			before = append(before, m)
+		}
+	}
+	if count > 0 && count < len(before) {
+		before = before[len(before)-count:]
+	}
+	return before, nil
+}
+
+func (s *MemoryMessageStore) LoadSince(network, target string, since time.Time) ([]HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var after []HistoryMessage
+	for _, m := range s.msgs[historyKey(network, target)] {
+		if m.Time.After(since) {
+			after = append(after, m)
+		}
+	}
+	return after, nil
+}
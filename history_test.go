@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileMessageStoreAppendIsMonotonicAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+
+	first := newFileMessageStore(dir)
+	for i := 0; i < 3; i++ {
+		if err := first.Append("libera", "#mub", HistoryMessage{Nick: "a", Time: time.Now(), Text: "hi"}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	// A fresh store pointed at the same directory simulates a
+	// restart; it must not reuse IDs already recorded on disk.
+	second := newFileMessageStore(dir)
+	if err := second.Append("libera", "#mub", HistoryMessage{Nick: "a", Time: time.Now(), Text: "after restart"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	msgs, err := second.Load("libera", "#mub", 0)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("got %d messages, want 4", len(msgs))
+	}
+	if msgs[3].ID != 4 {
+		t.Fatalf("got ID %d for post-restart message, want 4", msgs[3].ID)
+	}
+}
+
+func TestFileMessageStoreLoadBeforeAndSince(t *testing.T) {
+	dir := t.TempDir()
+	s := newFileMessageStore(dir)
+
+	base := time.Now()
+	for i := 0; i < 5; i++ {
+		msg := HistoryMessage{Nick: "a", Time: base.Add(time.Duration(i) * time.Second), Text: "msg"}
+		if err := s.Append("net", "#chan", msg); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	before, err := s.LoadBefore("net", "#chan", 3, 0)
+	if err != nil {
+		t.Fatalf("LoadBefore: %v", err)
+	}
+	if len(before) != 2 || before[0].ID != 1 || before[1].ID != 2 {
+		t.Fatalf("unexpected LoadBefore result: %+v", before)
+	}
+
+	since, err := s.LoadSince("net", "#chan", base.Add(2500*time.Millisecond))
+	if err != nil {
+		t.Fatalf("LoadSince: %v", err)
+	}
+	if len(since) != 2 || since[0].ID != 4 || since[1].ID != 5 {
+		t.Fatalf("unexpected LoadSince result: %+v", since)
+	}
+}
+
+func TestMemoryMessageStore(t *testing.T) {
+	s := newMemoryMessageStore()
+
+	for i := 0; i < 5; i++ {
+		if err := s.Append("net", "#chan", HistoryMessage{Text: "msg"}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	msgs, err := s.Load("net", "#chan", 2)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != 4 || msgs[1].ID != 5 {
+		t.Fatalf("unexpected Load result: %+v", msgs)
+	}
+
+	before, err := s.LoadBefore("net", "#chan", 3, 0)
+	if err != nil {
+		t.Fatalf("LoadBefore: %v", err)
+	}
+	if len(before) != 2 || before[1].ID != 2 {
+		t.Fatalf("unexpected LoadBefore result: %+v", before)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// registerincoming wires net's PRIVMSG/NOTICE handling into
+// onincoming. Without a real handler calling it, /detach's promise of
+// automatic reattach-on-message would just be dead code.
+func registerincoming(net *Network) {
+	onmsg := func(conn *irc.Conn, line *irc.Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		target := line.Args[0]
+		text := line.Args[len(line.Args)-1]
+
+		onincoming(net, line.Nick, target, text, false, servertime(line))
+	}
+
+	net.Conn.HandleFunc("PRIVMSG", onmsg)
+	net.Conn.HandleFunc("NOTICE", onmsg)
+}
+
+// servertime returns the time carried by line's IRCv3 server-time tag
+// (RFC3339 with fractional seconds, per the spec), or time.Now() if
+// the tag is missing or malformed -- e.g. because the network never
+// acknowledged the server-time capability. Parsed with RFC3339Nano
+// rather than a fixed layout, since the spec allows any number of
+// fractional digits (including none) and doesn't require a literal
+// "Z" -- servers do send numeric-offset timestamps.
+func servertime(line *irc.Line) time.Time {
+	if line.Tags == nil {
+		return time.Now()
+	}
+	raw, ok := line.Tags["time"]
+	if !ok {
+		return time.Now()
+	}
+	ts, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return time.Now()
+	}
+	return ts
+}
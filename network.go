@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// Network holds all per-connection state for a single IRC network. mub
+// used to keep this in package-level globals (conn, currtarget, the
+// completer's commandState); Network lets a client stay connected to
+// more than one network at a time, the way bouncer-style clients such
+// as soju do.
+type Network struct {
+	Name       string
+	Server     string
+	Conn       *irc.Conn
+	State      *commandState
+	CurrTarget string
+	Away       bool
+
+	// Acked holds the IRCv3 capabilities the server acknowledged
+	// during CAP negotiation, keyed by capability name.
+	Acked map[string]bool
+
+	// Activity tracks per-channel idle timers used for auto-detach.
+	// mu guards it: touch/forget run both from the UI goroutine and
+	// from the idle timers' own goroutines.
+	Activity map[string]*ChannelActivity
+	mu       sync.Mutex
+}
+
+// newNetwork returns a Network with freshly initialized command state.
+func newNetwork(name, server string) *Network {
+	return &Network{
+		Name:   name,
+		Server: server,
+		State: &commandState{
+			Channels: make(map[string]string),
+			NickMap:  make(map[string]string),
+			Detached: make(map[string]string),
+		},
+	}
+}
+
+// NetworkManager owns every Network a running client is connected to
+// and tracks which one is active in the UI.
+type NetworkManager struct {
+	Networks map[string]*Network
+	Active   string
+
+	// order records the sequence networks were added in, so Remove
+	// can pick a deterministic replacement instead of relying on Go's
+	// randomized map iteration order.
+	order []string
+}
+
+var netmgr = &NetworkManager{
+	Networks: make(map[string]*Network),
+}
+
+// Get returns the network registered under name, or nil if there is
+// none.
+func (nm *NetworkManager) Get(name string) *Network {
+	return nm.Networks[name]
+}
+
+// ActiveNetwork returns the currently active network, or nil if no
+// network has been added yet.
+func (nm *NetworkManager) ActiveNetwork() *Network {
+	return nm.Networks[nm.Active]
+}
+
+// Add registers net under name. The first network added becomes the
+// active one.
+func (nm *NetworkManager) Add(name string, net *Network) {
+	if _, exists := nm.Networks[name]; !exists {
+		nm.order = append(nm.order, name)
+	}
+	nm.Networks[name] = net
+	if nm.Active == "" {
+		nm.Active = name
+	}
+}
+
+// Remove drops the network registered under name. If it was active,
+// the network that was added earliest among those remaining becomes
+// active, or none at all if it was the last one.
+func (nm *NetworkManager) Remove(name string) {
+	delete(nm.Networks, name)
+	for i, n := range nm.order {
+		if n == name {
+			nm.order = append(nm.order[:i], nm.order[i+1:]...)
+			break
+		}
+	}
+
+	if nm.Active != name {
+		return
+	}
+	nm.Active = ""
+	if len(nm.order) > 0 {
+		nm.Active = nm.order[0]
+	}
+}
+
+// autoName derives a short network name from a server address, e.g.
+// "irc.libera.chat:6697" becomes "libera". Used so /connect and
+// /tlsconnect can register a network without the user having to name
+// one explicitly.
+func autoName(server string) string {
+	host := server
+	if i := strings.Index(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) >= 2 {
+		return parts[len(parts)-2]
+	}
+	return host
+}
+
+// activeState returns the commandState the completer and status
+// commands should operate on: the active network's state if one is
+// connected, otherwise the completer's own placeholder state.
+func activeState() *commandState {
+	if net := netmgr.ActiveNetwork(); net != nil {
+		return net.State
+	}
+	return commands.State
+}
+
+// setupnetwork registers a freshly-connected server under name as a
+// Network, makes it active, and wires everything a connection needs
+// beyond the raw IRC handshake: CAP/SASL negotiation, on-connect
+// config (auto-join, connect-cmd), and incoming-message handling.
+// Both /connect-family commands and /network add funnel through this
+// so the two entry points can't drift apart. sasl may be nil, in
+// which case it falls back to the matching config section's SASL
+// creds, if any.
+func setupnetwork(name, server string, sasl *SASLCreds) *Network {
+	net := newNetwork(name, server)
+	net.Conn = conn
+	netmgr.Add(name, net)
+	netmgr.Active = name
+
+	if sasl == nil {
+		if cfg := conf.Networks[name]; cfg != nil {
+			sasl = cfg.SASL
+		}
+	}
+
+	negotiatecaps(net, sasl)
+	applyconnectconfig(net, conf.Networks[name])
+	registerincoming(net)
+
+	return net
+}
+
+// parsenetworkcommand implements the /network add|list|switch|remove
+// subcommands.
+func parsenetworkcommand(args []string) {
+	switch args[0] {
+	case "list":
+		message(networklist())
+
+	case "add":
+		if len(args) < 4 {
+			warn("Use /network add <name> <server:port> <nick> [tls] [pass]")
+			return
+		}
+
+		name, server, nick := args[1], args[2], args[3]
+		tls := len(args) >= 5 && args[4] == "tls"
+		var pass string
+		if tls && len(args) >= 6 {
+			pass = args[5]
+		} else if !tls && len(args) >= 5 {
+			pass = args[4]
+		}
+
+		pendingSASL = nil
+		connect(server, nick, pass, tls)
+		setupnetwork(name, server, nil)
+
+	case "switch":
+		if len(args) != 2 {
+			warn("Use /network switch <name>")
+			return
+		}
+		if netmgr.Get(args[1]) == nil {
+			warn("No such network: " + args[1])
+			return
+		}
+		netmgr.Active = args[1]
+
+	case "remove":
+		if len(args) != 2 {
+			warn("Use /network remove <name>")
+			return
+		}
+		if netmgr.Get(args[1]) == nil {
+			warn("No such network: " + args[1])
+			return
+		}
+		netmgr.Remove(args[1])
+
+	default:
+		warn("Use /network add|list|switch|remove ...")
+	}
+}
+
+// networklist formats the known networks for /network list, marking
+// the active one.
+func networklist() string {
+	if len(netmgr.Networks) == 0 {
+		return "No networks configured."
+	}
+
+	var b strings.Builder
+	for name, net := range netmgr.Networks {
+		marker := "  "
+		if name == netmgr.Active {
+			marker = "* "
+		}
+		fmt.Fprintf(&b, "%s%s (%s)\n", marker, name, net.Server)
+	}
+
+	return strings.TrimRight(b.String(), "\n")
+}
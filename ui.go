@@ -8,6 +8,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/chzyer/readline"
@@ -26,6 +27,7 @@ type nickorchan string
 type nocommand struct{}
 
 type awaycommand struct {
+	Message string
 }
 
 type helpcommand struct{}
@@ -33,14 +35,18 @@ type helpcommand struct{}
 type tlsconnectcommand struct {
 	Server string "IRC server"
 	Nick   string "Your nickname"
+	Extra  string "[server-pass] [--sasl=external]"
 }
 
 type connectcommand struct {
 	Server string "IRC server"
 	Nick   string "Your nickname"
+	Extra  string "[server-pass] [--sasl=plain:user:pw]"
 }
 
-type quitcommand struct{}
+type quitcommand struct {
+	Reason string
+}
 
 type querycommand struct {
 	Target nickorchan "channel or nick"
@@ -67,18 +73,49 @@ type mecommand struct {
 }
 
 type msgcommand struct {
-	Nick nickname "nick"
+	Target nickorchan "channel or nick"
+	Text   string
 }
 
 type namescommand struct{}
 
 type statuscommand struct{}
 
+type networkcommand struct {
+	Args string "add|list|switch|remove ..."
+}
+
+type historycommand struct {
+	Target   nickorchan "channel or nick"
+	Modifier string
+}
+
+type reloadconfigcommand struct{}
+
+type detachcommand struct {
+	Channel string "channel"
+}
+
+type attachcommand struct {
+	Channel string "channel"
+}
+
 // commandState is the internal state of completer.
 type commandState struct {
 	FoundCmd int
 	Channels map[string]string
 	NickMap  map[string]string
+
+	// Detached holds channels that have been auto-detached (hidden
+	// locally, still joined server-side) or manually detached with
+	// /detach.
+	Detached map[string]string
+
+	// mu guards Channels, NickMap and Detached: they're read from the
+	// completer's goroutine and written from the UI goroutine as well
+	// as goirc's own handler goroutines (incoming-message handling)
+	// and auto-detach's idle timers.
+	mu sync.Mutex
 }
 
 // commands keeps a list of commands and the internal state of the
@@ -122,7 +159,12 @@ var (
 			{"/msg", msgcommand{}, "Send a message to a specific target."},
 			{"/nick", nickcommand{}, "Change your nickname."},
 			{"/names", namescommand{}, "List members on current channel."},
-			{"/status", statuscommand{}, "Toggle status join, quit messages."}},
+			{"/status", statuscommand{}, "Toggle status join, quit messages."},
+			{"/network", networkcommand{}, "Manage networks: add|list|switch|remove."},
+			{"/history", historycommand{}, "Show history for a target: count, since=<time> or before=<id>."},
+			{"/reloadconfig", reloadconfigcommand{}, "Reload the config file without restarting."},
+			{"/detach", detachcommand{}, "Detach from a channel, keeping it for later reattach."},
+			{"/attach", attachcommand{}, "Reattach a detached channel."}},
 	}
 )
 
@@ -163,7 +205,11 @@ func (c Commands) Do(line []rune, pos int) (newLine [][]rune, length int) {
 			}
 		} else {
 			// Nick completion.
-			newLine = findmap(linestr[space+1:], c.State.NickMap, pos, ": ")
+			state := activeState()
+			state.mu.Lock()
+			nicks := copyStrMap(state.NickMap)
+			state.mu.Unlock()
+			newLine = findmap(linestr[space+1:], nicks, pos, ": ")
 		}
 	} else {
 		// Argument completion.
@@ -173,19 +219,36 @@ func (c Commands) Do(line []rune, pos int) (newLine [][]rune, length int) {
 		// ...and our position in the this word is:
 		wordpos := pos - len(head)
 
+		state := activeState()
+		state.mu.Lock()
+		channels := copyStrMap(state.Channels)
+		nicks := copyStrMap(state.NickMap)
+		detached := copyStrMap(state.Detached)
+		state.mu.Unlock()
+
 		switch c.Commands[c.State.FoundCmd].Prototype.(type) {
 		case msgcommand:
 			newLine = CompleteNickOrChan(linestr, space, wordpos,
-				c.State.Channels, c.State.NickMap)
+				channels, nicks)
 		case querycommand:
 			newLine = CompleteNickOrChan(linestr, space, wordpos,
-				c.State.Channels, c.State.NickMap)
+				channels, nicks)
+		case historycommand:
+			newLine = CompleteNickOrChan(linestr, space, wordpos,
+				channels, nicks)
 		case whoiscommand:
-			newLine = findmap(linestr[space+1:], c.State.NickMap, wordpos, "")
+			newLine = findmap(linestr[space+1:], nicks, wordpos, "")
 		case joincommand:
-			newLine = findmap(linestr[space+1:], c.State.Channels, wordpos, "")
+			newLine = findmap(linestr[space+1:], channels, wordpos, "")
+			newLine = append(newLine, findmap(linestr[space+1:], detached, wordpos, " (detached)")...)
 		case partcommand:
-			newLine = findmap(linestr[space+1:], c.State.Channels, wordpos, "")
+			newLine = findmap(linestr[space+1:], channels, wordpos, "")
+		case attachcommand:
+			newLine = findmap(linestr[space+1:], detached, wordpos, " (detached)")
+		case detachcommand:
+			newLine = findmap(linestr[space+1:], channels, wordpos, "")
+		case networkcommand:
+			newLine = findmatch(linestr[space+1:], []string{"add", "list", "switch", "remove"}, wordpos)
 		}
 	}
 
@@ -205,6 +268,16 @@ func findmatch(arg string, args []string, wordpos int) (newLine [][]rune) {
 	return
 }
 
+// copyStrMap returns a shallow copy of m, so callers can range over
+// the result without holding whatever lock protects the original.
+func copyStrMap(m map[string]string) map[string]string {
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
 // Look for argument with prefix arg in the map args. wordpos is where
 // our cursor is. Just return whatever is after that.
 //
@@ -232,8 +305,10 @@ func warn(msg string) {
 	message(msg)
 }
 
-// An incoming message or action from another participant.
-func showmsg(nick string, target string, text string, action bool) {
+// An incoming message or action from another participant. ts is the
+// time the message was sent; pass time.Now() if the server didn't
+// supply a server-time tag.
+func showmsg(nick string, target string, text string, action bool, ts time.Time) {
 	var str string
 
 	if action {
@@ -242,7 +317,7 @@ func showmsg(nick string, target string, text string, action bool) {
 		str = fmt.Sprintf("%v <%v> %v", target, nick, text)
 	}
 
-	message(str)
+	messageAt(str, ts)
 }
 
 // Sanitize string msg from ESC and control characters.
@@ -287,7 +362,14 @@ func wrap(msg string, col int) (out string) {
 // sanitizes them, timestamps them and possibly word wraps and might
 // do other things depending on output type.
 func message(msg string) {
-	timestr := time.Now().Format("15:04")
+	messageAt(msg, time.Now())
+}
+
+// messageAt is like message but timestamps the line with ts instead of
+// the current time, so messages carrying an IRCv3 server-time tag
+// display when they were actually sent.
+func messageAt(msg string, ts time.Time) {
+	timestr := ts.Format("15:04")
 	msg = sanitizestring(msg)
 	msg = fmt.Sprintf("%v %s", timestr, msg)
 
@@ -296,42 +378,39 @@ func message(msg string) {
 	fmt.Fprintf(output.Output, "%s\n", msg)
 }
 
+// usage renders a one-line "/cmd <arg1> <arg2>" hint from cmd's
+// prototype fields, shared by printhelp and parsecommand's error
+// messages so both stay in sync as commands gain or lose arguments.
+func usage(cmd command) string {
+	msg := cmd.Name
+	prototype := reflect.TypeOf(cmd.Prototype)
+	for i := 0; i < prototype.NumField(); i++ {
+		msg += " <" + strings.ToLower(prototype.Field(i).Name) + ">"
+	}
+	return msg
+}
+
 func printhelp() {
 	for _, cmd := range commands.Commands {
-		msg := cmd.Name
-		prototype := reflect.TypeOf(cmd.Prototype)
-		for i := 0; i < prototype.NumField(); i++ {
-			msg += " <" + strings.ToLower(prototype.Field(i).Name) + ">"
-		}
+		message(usage(cmd) + " - " + cmd.Desc)
+	}
+}
 
-		message(msg + " - " + cmd.Desc)
+// findcommand looks up name in the commands table.
+func findcommand(name string) (command, bool) {
+	for _, cmd := range commands.Commands {
+		if cmd.Name == name {
+			return cmd, true
+		}
 	}
+	return command{}, false
 }
 
+// parsecommand looks up the handler registered for the command named
+// by line's first word, builds its typed argument struct by walking
+// the command's prototype (see parseargs), and calls the handler.
 func parsecommand(line string) {
 	fields := strings.Fields(line)
-	// Calculate line pos of where first & second argument begins -- for
-	// using as "rest of line" by relevant commands. Does not omit any
-	// initial spaces of those arguments, ie:
-	// line:/me  slaps quite
-	//          ^- firstpos
-	// line:/msg   quite   . . . it was a trout
-	//                   ^- secondpos
-	firstpos := 0
-	secondpos := 0
-	if len(fields) >= 2 {
-		firstpos = strings.Index(line, " ")
-		firstpos++
-	}
-	if len(fields) >= 3 {
-		secondpos = firstpos
-		// skipping all spaces between command and first arg
-		for line[secondpos] == ' ' {
-			secondpos++
-		}
-		secondpos += strings.Index(line[secondpos:], " ")
-		secondpos++
-	}
 
 	// Check if this command is allowed.
 	if _, val := conf.BlockedCommands[fields[0]]; val {
@@ -339,174 +418,20 @@ func parsecommand(line string) {
 		return
 	}
 
-	switch fields[0] {
-	case "/away":
-		if conn == nil {
-			noconnection()
-			break
-		}
-		if len(fields) >= 2 {
-			conn.Away(line[firstpos:])
-			away()
-		} else {
-			conn.Away()
-			back()
-		}
-
-	case "/help":
-		printhelp()
-
-	case "/tlsconnect":
-		var pass string
-
-		if len(fields) < 3 {
-			warn("Use /connect server:port nick [server-pass]")
-			return
-		}
-		if len(fields) == 4 {
-			pass = fields[3]
-		}
-
-		connect(fields[1], fields[2], pass, true)
-
-	case "/connect":
-		var pass string
-
-		if len(fields) < 3 {
-			warn("Use /connect server:port nick [server-pass]")
-			return
-		}
-		if len(fields) == 4 {
-			pass = fields[3]
-		}
-
-		connect(fields[1], fields[2], pass, false)
-
-	case "/nick":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		conn.Nick(fields[1])
-
-	case "/join":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		if len(fields) != 2 {
-			warn("Use /join #channel")
-			return
-		}
-
-		currtarget = fields[1]
-		conn.Join(currtarget)
-		commands.State.Channels[currtarget] = currtarget
-	case "/part":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		if len(fields) != 2 {
-			warn("Use /part #channel")
-			return
-		}
-
-		conn.Part(fields[1])
-		currtarget = ""
-		// Forget about this channel
-		delete(commands.State.Channels, currtarget)
-	case "/me":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		if len(fields) < 2 {
-			warn("Use /me action text")
-			return
-		}
-
-		conn.Action(currtarget, line[firstpos:])
-		logmsg(time.Now(), conn.Me().Nick, currtarget, line[firstpos:], true)
-
-	case "/names":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		namescmd := fmt.Sprintf("NAMES %v", currtarget)
-		conn.Raw(namescmd)
-
-	case "/status":
-		if statusEvents {
-			statusEvents = false
-			message("Not showing quits, joins, et cetera.")
-		} else {
-			statusEvents = true
-			message("Showing quits, joins, et cetera.")
-		}
-
-	case "/whois":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		if len(fields) != 2 {
-			warn("Use /whois <nick>")
-			return
-		}
-
-		conn.Whois(fields[1])
-
-	case "/msg":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		if len(fields) < 3 {
-			warn("Use /msg target message text")
-			return
-		}
-
-		conn.Privmsg(fields[1], line[secondpos:])
-		logmsg(time.Now(), conn.Me().Nick, fields[1], line[secondpos:], false)
-	case "/x":
-		fallthrough
-	case "/query":
-		if conn == nil {
-			noconnection()
-			break
-		}
-
-		if len(fields) != 2 {
-			warn("Use /query <nick/channel>")
-			return
-		}
-
-		currtarget = fields[1]
-
-	case "/quit":
-		iquit()
-		if conn != nil {
-			if len(fields) == 2 {
-				conn.Quit(fields[1])
-			} else {
-				conn.Quit()
-			}
-		}
-
-		quitclient = true
-
-	default:
+	cmd, ok := findcommand(fields[0])
+	h, hasHandler := handlers[fields[0]]
+	if !ok || !hasHandler {
 		warn("Unknown command: " + fields[0])
+		return
+	}
+
+	args, err := parseargs(cmd.Prototype, line, fields, activeState(), strictNicks)
+	if err != nil {
+		warn(err.Error() + " -- usage: " + usage(cmd))
+		return
 	}
+
+	h(&Context{Net: netmgr.ActiveNetwork()}, args)
 }
 
 func initUI(subprocess bool) (rl *readline.Instance, bio *bufio.Reader) {
@@ -515,6 +440,13 @@ func initUI(subprocess bool) (rl *readline.Instance, bio *bufio.Reader) {
 	commands.State = new(commandState)
 	commands.State.NickMap = make(map[string]string)
 	commands.State.Channels = make(map[string]string)
+	commands.State.Detached = make(map[string]string)
+
+	if err := loadConfig(); err != nil {
+		log.Printf("Couldn't load config: %v", err)
+	} else {
+		autoconnect()
+	}
 
 	if subprocess {
 		// We're running as a subprocess. Just read from stdin.
@@ -558,7 +490,12 @@ func ui(subprocess bool, rl *readline.Instance, bio *bufio.Reader) {
 				log.Fatal("Couldn't get input.\n")
 			}
 		} else {
-			rl.SetPrompt("\033[33m" + currtarget + "> \033[0m")
+			netname := netmgr.Active
+			target := ""
+			if net := netmgr.ActiveNetwork(); net != nil {
+				target = net.CurrTarget
+			}
+			rl.SetPrompt(fmt.Sprintf("\033[33m[%v] %v> \033[0m", netname, target))
 			line, err = rl.Readline()
 			if err != nil {
 				break
@@ -571,11 +508,15 @@ func ui(subprocess bool, rl *readline.Instance, bio *bufio.Reader) {
 				parsecommand(line)
 			} else {
 				// Send line to target.
-				if currtarget == "" {
+				net := netmgr.ActiveNetwork()
+				if net == nil || net.CurrTarget == "" {
 					notarget()
 				} else {
-					conn.Privmsg(currtarget, line)
-					logmsg(time.Now(), conn.Me().Nick, currtarget, line, false)
+					net.Conn.Privmsg(net.CurrTarget, line)
+					net.touch(net.CurrTarget)
+					history.Append(net.Name, net.CurrTarget, HistoryMessage{
+						Nick: net.Conn.Me().Nick, Time: time.Now(), Action: false, Text: line,
+					})
 				}
 			}
 		}